@@ -0,0 +1,254 @@
+// Package cache implements an on-disk, content-addressed caching layer
+// that sits between the TFTP read handler and the HTTP backend. Cached
+// responses are keyed by request URL, stored under the SHA-256 of that URL
+// with the SHA-256 of their content recorded in a metadata file, and
+// revalidated against the backend using ETag/Last-Modified headers.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// entryMeta is persisted alongside each cached file so freshness and
+// revalidation can be checked without re-reading the file body.
+type entryMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentHash  string    `json:"content_hash"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// Cache is an on-disk, LRU-evicted cache of HTTP responses keyed by URL.
+type Cache struct {
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	hits   uint64
+	misses uint64
+}
+
+// New creates a Cache rooted at dir, creating the directory if needed.
+// maxSize is the total size in bytes the cache may occupy before the
+// least-recently-used entries (by mtime) are evicted; zero means
+// unbounded. ttl is how long a cached entry is served without
+// revalidating against the backend; zero means entries are served without
+// ever being revalidated.
+func New(dir string, maxSize int64, ttl time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create cache dir: %v", err)
+	}
+	return &Cache{dir: dir, maxSize: maxSize, ttl: ttl}, nil
+}
+
+// Stats returns the cumulative hit and miss counts since the cache was
+// created, for exposing a hit-ratio metric.
+func (c *Cache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+func (c *Cache) keyFor(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) paths(key string) (dataPath, metaPath string) {
+	sub := filepath.Join(c.dir, key[:2])
+	return filepath.Join(sub, key), filepath.Join(sub, key+".meta")
+}
+
+func (c *Cache) readMeta(metaPath string) (*entryMeta, error) {
+	raw, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	meta := &entryMeta{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Get serves req.URL.String() from cache when possible, otherwise fetches
+// it through client, streaming the body into the cache while computing its
+// SHA-256 and renaming it into place atomically. It returns an open handle
+// to the cached file positioned at the start, and its size.
+func (c *Cache) Get(client *http.Client, req *http.Request) (*os.File, int64, error) {
+	key := c.keyFor(req.URL.String())
+	dataPath, metaPath := c.paths(key)
+
+	if meta, err := c.readMeta(metaPath); err == nil {
+		if c.ttl <= 0 || time.Since(meta.FetchedAt) < c.ttl {
+			if f, size, err := c.openFresh(dataPath); err == nil {
+				os.Chtimes(dataPath, time.Now(), time.Now())
+				atomic.AddUint64(&c.hits, 1)
+				return f, size, nil
+			}
+		} else {
+			if revalidated, err := c.revalidate(client, req, meta); err == nil && revalidated {
+				os.Chtimes(dataPath, time.Now(), time.Now())
+				if f, size, err := c.openFresh(dataPath); err == nil {
+					atomic.AddUint64(&c.hits, 1)
+					return f, size, nil
+				}
+			}
+		}
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	return c.fetchAndStore(client, req, key, dataPath, metaPath)
+}
+
+func (c *Cache) openFresh(dataPath string) (*os.File, int64, error) {
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// revalidate issues a conditional GET using the cached ETag/Last-Modified
+// and reports whether the backend confirmed the cached copy is still
+// current (304 Not Modified).
+func (c *Cache) revalidate(client *http.Client, req *http.Request, meta *entryMeta) (bool, error) {
+	condReq := req.Clone(req.Context())
+	if meta.ETag != "" {
+		condReq.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		condReq.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+
+	resp, err := client.Do(condReq)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return resp.StatusCode == http.StatusNotModified, nil
+}
+
+func (c *Cache) fetchAndStore(client *http.Client, req *http.Request, key, dataPath, metaPath string) (*os.File, int64, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, 0, fmt.Errorf("File not found")
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("backend returned status %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
+		return nil, 0, fmt.Errorf("unable to create cache subdir: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dataPath), key+".tmp-")
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to create temp file: %v", err)
+	}
+	tmpPath := tmp.Name()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), resp.Body); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return nil, 0, fmt.Errorf("unable to write cache file: %v", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, dataPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, 0, fmt.Errorf("unable to install cache file: %v", err)
+	}
+
+	meta := entryMeta{
+		URL:          req.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentHash:  hex.EncodeToString(hasher.Sum(nil)),
+		FetchedAt:    time.Now(),
+	}
+	metaRaw, err := json.Marshal(meta)
+	if err == nil {
+		ioutil.WriteFile(metaPath, metaRaw, 0644)
+	} else {
+		log.Printf("WARN: cache: unable to marshal metadata for %s: %v", req.URL, err)
+	}
+
+	c.evictIfNeeded()
+
+	return c.openFresh(dataPath)
+}
+
+// evictIfNeeded removes the least-recently-used (by mtime) cached files
+// until the cache is back under maxSize. It is best-effort: errors walking
+// or removing files are logged, not returned, since they must never fail a
+// request whose response has already been fetched and stored.
+func (c *Cache) evictIfNeeded() {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	type entry struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var entries []entry
+	var total int64
+
+	filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) == ".meta" {
+			return nil
+		}
+		entries = append(entries, entry{path: path, size: info.Size(), mtime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	if total <= c.maxSize {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime.Before(entries[j].mtime) })
+
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			log.Printf("WARN: cache: unable to evict %s: %v", e.path, err)
+			continue
+		}
+		os.Remove(e.path + ".meta")
+		total -= e.size
+	}
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheGetFetchesOnceAndServesFromDisk(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("firmware-bytes"))
+	}))
+	defer srv.Close()
+
+	c, err := New(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", srv.URL+"/firmware.bin", nil)
+		f, size, err := c.Get(srv.Client(), req)
+		if err != nil {
+			t.Fatalf("Get() unexpected error: %v", err)
+		}
+		body, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(body) != "firmware-bytes" || size != int64(len(body)) {
+			t.Fatalf("Get() returned %q (size %d), want %q", body, size, "firmware-bytes")
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("backend received %d requests, want 1 (later Gets should be served from disk)", requests)
+	}
+	if hits, misses := c.Stats(); hits != 2 || misses != 1 {
+		t.Errorf("Stats() = (%d, %d), want (2, 1)", hits, misses)
+	}
+}
+
+func TestCacheGetRevalidatesAfterTTL(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("firmware-bytes"))
+	}))
+	defer srv.Close()
+
+	c, err := New(t.TempDir(), 0, time.Millisecond)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/firmware.bin", nil)
+	f, _, err := c.Get(srv.Client(), req)
+	if err != nil {
+		t.Fatalf("Get() unexpected error: %v", err)
+	}
+	f.Close()
+
+	time.Sleep(5 * time.Millisecond)
+
+	f, _, err = c.Get(srv.Client(), req)
+	if err != nil {
+		t.Fatalf("Get() unexpected error after TTL expiry: %v", err)
+	}
+	f.Close()
+
+	if requests != 2 {
+		t.Errorf("backend received %d requests, want 2 (initial fetch + revalidation)", requests)
+	}
+}
+
+func TestCacheGetNotFoundReportsSameSignalAsUncachedPath(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	c, err := New(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/missing.bin", nil)
+	_, _, err = c.Get(srv.Client(), req)
+	if err == nil {
+		t.Fatal("Get() expected an error for a 404 response, got none")
+	}
+	if err.Error() != "File not found" {
+		t.Errorf(`Get() error = %q, want "File not found" so callers can classify it like the uncached path`, err.Error())
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsedOverMaxSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x")) // fixed 1-byte body so maxSize controls entry count, not content length
+	}))
+	defer srv.Close()
+
+	c, err := New(t.TempDir(), 2, 0)
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+
+	for _, path := range []string{"/a", "/bb", "/ccc"} {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		f, _, err := c.Get(srv.Client(), req)
+		if err != nil {
+			t.Fatalf("Get(%s) unexpected error: %v", path, err)
+		}
+		f.Close()
+		time.Sleep(time.Millisecond) // keep mtimes distinct for LRU ordering
+	}
+
+	reqA, _ := http.NewRequest("GET", srv.URL+"/a", nil)
+	if _, _, err := c.openFresh(mustDataPath(t, c, reqA)); err == nil {
+		t.Error("expected the oldest entry (/a) to have been evicted")
+	}
+}
+
+func mustDataPath(t *testing.T, c *Cache, req *http.Request) string {
+	t.Helper()
+	dataPath, _ := c.paths(c.keyFor(req.URL.String()))
+	return dataPath
+}
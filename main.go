@@ -1,22 +1,46 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"github.com/pin/tftp"
 	systemd "github.com/coreos/go-systemd/daemon"
+	"github.com/thuliumcc/tftp-http-proxy/cache"
+	"github.com/thuliumcc/tftp-http-proxy/metrics"
+	"github.com/thuliumcc/tftp-http-proxy/rules"
 )
 
 const httpBaseUrlDefault = "http://127.0.0.1/tftp"
 const tftpTimeoutDefault = 5 * time.Second
 const tftpBindAddrDefault = ":69"
 const appendPathDefault = true
+const shutdownTimeoutDefault = 10 * time.Second
+const writeMethodDefault = "PUT"
+const metricsAddrDefault = ":9669"
+
+// inheritFdEnv is set on the child spawned for SIGUSR2 live-reload so it
+// knows to adopt the already-bound UDP socket (passed as fd 3) instead of
+// binding a fresh one.
+const inheritFdEnv = "TFTP_HTTP_PROXY_INHERIT_FD"
+
+// transfersWg tracks in-flight TFTP transfers so graceful shutdown can wait
+// for them to finish before the process exits.
+var transfersWg sync.WaitGroup
 
 var globalState = struct {
 	httpBaseUrl	string
@@ -24,20 +48,121 @@ var globalState = struct {
 	appendPath	bool
 	authUsername    string
 	authPassword    string
+	cacheDir        string
+	cacheMaxSize    int64
+	cacheTTL        time.Duration
+	cache           *cache.Cache
+	enableWrite     bool
+	writeMethod     string
+	rulesFile       string
+	rules           *rules.Engine
 }{
 	httpBaseUrl:	httpBaseUrlDefault,
 	httpClient:	nil,
 	appendPath:	appendPathDefault,
 	authUsername:   "",
 	authPassword:   "",
+	cacheDir:       "",
+	cacheMaxSize:   0,
+	cacheTTL:       0,
+	cache:          nil,
+	enableWrite:    false,
+	writeMethod:    writeMethodDefault,
+	rulesFile:      "",
+	rules:          nil,
+}
+
+// buildTLSConfig assembles a *tls.Config for the backend HTTP client from
+// the --http-tls-* flags.  It returns nil (use Go's defaults) when none of
+// the flags were set, so existing plain-HTTP and default-TLS deployments
+// are unaffected. Errors are returned rather than panicking so a SIGHUP
+// reload against a since-changed/removed TLS file can be reported and
+// ignored instead of taking the whole process down.
+func buildTLSConfig(caFile, clientCertFile, clientKeyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caFile == "" && clientCertFile == "" && clientKeyFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFile != "" {
+		pemBytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read --http-tls-ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("--http-tls-ca file contains no valid certificates: %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (clientCertFile == "") != (clientKeyFile == "") {
+		return nil, fmt.Errorf("--http-tls-client-cert and --http-tls-client-key must be given together")
+	}
+	if clientCertFile != "" && clientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS client key pair: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
-func tftpReadHandler(filename string, rf io.ReaderFrom) error {
+func tftpReadHandler(filename string, rf io.ReaderFrom) (err error) {
+	transfersWg.Add(1)
+	defer transfersWg.Done()
+
+	metrics.InFlightTransfers.Inc()
+	defer metrics.InFlightTransfers.Dec()
+
+	start := time.Now()
+	defer func() {
+		metrics.TransferDuration.Observe(time.Since(start).Seconds())
+		switch {
+		case err == nil:
+			metrics.RequestsTotal.WithLabelValues("ok").Inc()
+		case err.Error() == "File not found":
+			metrics.RequestsTotal.WithLabelValues("not_found").Inc()
+		default:
+			metrics.RequestsTotal.WithLabelValues("error").Inc()
+		}
+	}()
+
 	raddr := rf.(tftp.OutgoingTransfer).RemoteAddr() // net.UDPAddr
 
 	log.Printf("INFO: New TFTP request (%s) from %s", filename, raddr.IP.String())
 
-	uri := globalState.httpBaseUrl
+	baseUrl := globalState.httpBaseUrl
+	authUsername := globalState.authUsername
+	authPassword := globalState.authPassword
+
+	if globalState.rules != nil {
+		match, err := globalState.rules.Resolve(raddr.IP, filename)
+		if err != nil {
+			log.Printf("ERR: rules: %v", err)
+			return err
+		}
+		if match.Deny {
+			log.Printf("INFO: request denied by rule (%s, from %s)", filename, raddr.IP.String())
+			return fmt.Errorf("Access denied")
+		}
+		resolvedBaseUrl, err := normalizeBaseURL(match.BaseURL, globalState.appendPath)
+		if err != nil {
+			log.Printf("ERR: rule base_url %q is invalid: %v", match.BaseURL, err)
+			return err
+		}
+		baseUrl = resolvedBaseUrl
+		filename = match.Filename
+		authUsername = match.AuthUsername
+		authPassword = match.AuthPassword
+	}
+
+	uri := baseUrl
 	if globalState.appendPath {
 		// No need to validate url any further, http.NewRequest does
 		// this for us using url.Parse().  We already checked that base
@@ -56,10 +181,32 @@ func tftpReadHandler(filename string, rf io.ReaderFrom) error {
 	req.Header.Add("X-TFTP-IP", raddr.IP.String())
 	req.Header.Add("X-TFTP-Port", fmt.Sprintf("%d", raddr.Port))
 	req.Header.Add("X-TFTP-File", filename)
-	if globalState.authUsername != "" {
-		req.SetBasicAuth(globalState.authUsername, globalState.authPassword)
+	if authUsername != "" {
+		req.SetBasicAuth(authUsername, authPassword)
+	}
+	if globalState.cache != nil {
+		backendStart := time.Now()
+		f, size, err := globalState.cache.Get(globalState.httpClient, req)
+		metrics.BackendLatency.Observe(time.Since(backendStart).Seconds())
+		if err != nil {
+			log.Printf("ERR: cache fetch failed: %v", err)
+			return err
+		}
+		defer f.Close()
+
+		rf.(tftp.OutgoingTransfer).SetSize(size)
+		n, err := rf.ReadFrom(f)
+		if err != nil {
+			log.Printf("ERR: ReadFrom failed: %v", err)
+			return err
+		}
+		metrics.BytesServed.Add(float64(n))
+		return nil
 	}
+
+	backendStart := time.Now()
 	resp, err := globalState.httpClient.Do(req)
+	metrics.BackendLatency.Observe(time.Since(backendStart).Seconds())
 	if err != nil {
 		log.Printf("ERR: http request failed: %v", err)
 		return err
@@ -79,64 +226,451 @@ func tftpReadHandler(filename string, rf io.ReaderFrom) error {
 		rf.(tftp.OutgoingTransfer).SetSize(resp.ContentLength)
 	}
 
-	_, err = rf.ReadFrom(resp.Body)
+	n, err := rf.ReadFrom(resp.Body)
 	if err != nil {
 		log.Printf("ERR: ReadFrom failed: %v", err)
 		return err
 	}
+	metrics.BytesServed.Add(float64(n))
 
 	return nil
 }
 
-func parseBaseURL(baseUrl string, appendPath bool) string {
+// tftpWriteHandler streams an incoming TFTP WRQ straight through to the
+// HTTP backend: the data read from the TFTP client is piped, without
+// buffering the whole transfer in memory, into the body of an HTTP
+// PUT/POST request against the configured base URL. It is only wired up
+// when --enable-write is set.
+func tftpWriteHandler(filename string, wt io.WriterTo) error {
+	raddr := wt.(tftp.IncomingTransfer).RemoteAddr() // net.UDPAddr
+
+	log.Printf("INFO: New TFTP upload (%s) from %s", filename, raddr.IP.String())
+
+	uri := globalState.httpBaseUrl
+	if globalState.appendPath {
+		uri = uri + strings.TrimLeft(filename, "/")
+	}
+
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequest(globalState.writeMethod, uri, pr)
+	if err != nil {
+		log.Printf("ERR: http request setup failed: %v", err)
+		return err
+	}
+	req.Header.Add("X-TFTP-IP", raddr.IP.String())
+	req.Header.Add("X-TFTP-Port", fmt.Sprintf("%d", raddr.Port))
+	req.Header.Add("X-TFTP-File", filename)
+	if globalState.authUsername != "" {
+		req.SetBasicAuth(globalState.authUsername, globalState.authPassword)
+	}
+
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := wt.WriteTo(pw)
+		pw.CloseWithError(err)
+		writeErrCh <- err
+	}()
+
+	resp, err := globalState.httpClient.Do(req)
+	if err != nil {
+		log.Printf("ERR: http request failed: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if writeErr := <-writeErrCh; writeErr != nil {
+		log.Printf("ERR: WriteTo failed: %v", writeErr)
+		return writeErr
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("ERR: http request returned status %s", resp.Status)
+		return fmt.Errorf("HTTP request error: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// normalizeBaseURL validates that baseUrl has a scheme and a host and, when
+// appendPath is set, ensures it ends in a slash so a filename can be
+// appended directly. It reports a malformed URL as an error rather than
+// panicking, so callers on the per-request path (rule resolution) can fail
+// that one request instead of taking the process down.
+func normalizeBaseURL(baseUrl string, appendPath bool) (string, error) {
 	u, err := url.ParseRequestURI(baseUrl)
 	if err != nil {
-		log.Panicf("FATAL: invalid base URL: %v\n", err)
+		return "", fmt.Errorf("invalid base URL: %v", err)
 	}
-	if (u.Scheme == "") {
-		log.Panicf("FATAL: invalid base URL: No scheme found.\n")
+	if u.Scheme == "" {
+		return "", fmt.Errorf("invalid base URL: no scheme found")
 	}
-	if (u.Host == "") {
-		log.Panicf("FATAL: invalid base URL: No host found.\n")
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid base URL: no host found")
 	}
 	base := u.String()
 	if appendPath && !strings.HasSuffix(base, "/") {
-		return base + "/"
-	} else {
-		return base
+		return base + "/", nil
 	}
+	return base, nil
 }
 
-func main() {
-	httpBaseUrlPtr := flag.String("http-base-url", httpBaseUrlDefault, "HTTP base URL")
-	appendPathPtr := flag.Bool("http-append-path", appendPathDefault, "append TFTP filename to URL")
-	tftpTimeoutPtr := flag.Duration("tftp-timeout", tftpTimeoutDefault, "TFTP timeout")
-	bindAddrPtr := flag.String("tftp-bind-address", tftpBindAddrDefault, "TFTP addr to bind to")
-	authUsername := flag.String("http-auth-user", "" , "HTTP auth user")
-	authPassword := flag.String("http-auth-pass", "" , "HTTP auth password")
-
-	flag.Parse()
-
-	globalState.httpBaseUrl = parseBaseURL(*httpBaseUrlPtr, *appendPathPtr)
-	globalState.httpClient = &http.Client{}
-	globalState.appendPath = *appendPathPtr
-	globalState.authUsername = *authUsername
-	globalState.authPassword = *authPassword
-
-	s := tftp.NewServer(tftpReadHandler, nil)
-	s.SetTimeout(*tftpTimeoutPtr)
-	err := s.ListenAndServe2(*bindAddrPtr, func() {
-		log.Printf("INFO: Listening TFTP requests on: %s", *bindAddrPtr)
-		sent, err := systemd.SdNotify(true, "READY=1\n");
-		if err != nil {
-			log.Printf("WARN: Unable to send systemd daemon successful start message: %v\n", err)
-		} else if (sent) {
-			log.Printf("DEBUG: Systemd was notified.\n")
+// config holds the settings that are only read at startup: TFTP bind
+// address, TFTP and shutdown timeouts and metrics address. A SIGHUP reload
+// re-parses them but does not apply them; it only changes what is in
+// globalState (backend base URL, HTTP client, auth, cache, write method and
+// rules).
+type config struct {
+	bindAddr        string
+	tftpTimeout     time.Duration
+	shutdownTimeout time.Duration
+	metricsAddr     string
+}
+
+// appliedConfig is the result of parsing and validating args, ready to be
+// applied onto globalState. Keeping it separate from globalState lets
+// parseFlagsArgs fully validate a set of flags before anything is
+// committed, so a failed SIGHUP reload never leaves globalState partially
+// updated.
+type appliedConfig struct {
+	httpBaseUrl  string
+	httpClient   *http.Client
+	appendPath   bool
+	authUsername string
+	authPassword string
+	cacheDir     string
+	cacheMaxSize int64
+	cacheTTL     time.Duration
+	cache        *cache.Cache
+	enableWrite  bool
+	writeMethod  string
+	rulesFile    string
+	rules        *rules.Engine
+	cfg          config
+}
+
+// parseFlagsArgs parses and validates args (normally os.Args[1:]) into an
+// appliedConfig. It reads but never modifies globalState and never panics or exits,
+// so it is safe to call from both the startup path and the SIGHUP reload
+// path, which must not crash the process over a now-invalid flag or config
+// file. The cache and rules engine are only rebuilt when the flags that
+// control them actually changed since the last successful parse, so a
+// reload that doesn't touch --cache-dir/--cache-max-size/--cache-ttl keeps
+// the existing *cache.Cache (and the hit/miss counters behind it) instead
+// of silently resetting them.
+func parseFlagsArgs(args []string) (*appliedConfig, error) {
+	fs := flag.NewFlagSet("tftp-http-proxy", flag.ContinueOnError)
+	httpBaseUrlPtr := fs.String("http-base-url", httpBaseUrlDefault, "HTTP base URL")
+	appendPathPtr := fs.Bool("http-append-path", appendPathDefault, "append TFTP filename to URL")
+	tftpTimeoutPtr := fs.Duration("tftp-timeout", tftpTimeoutDefault, "TFTP timeout")
+	bindAddrPtr := fs.String("tftp-bind-address", tftpBindAddrDefault, "TFTP addr to bind to")
+	authUsername := fs.String("http-auth-user", "" , "HTTP auth user")
+	authPassword := fs.String("http-auth-pass", "" , "HTTP auth password")
+	httpTLSCa := fs.String("http-tls-ca", "", "PEM file with CA certificates to trust for the HTTP backend")
+	httpTLSClientCert := fs.String("http-tls-client-cert", "", "PEM file with client certificate for mutual TLS")
+	httpTLSClientKey := fs.String("http-tls-client-key", "", "PEM file with client private key for mutual TLS")
+	httpTLSInsecureSkipVerify := fs.Bool("http-tls-insecure-skip-verify", false, "skip verification of the HTTP backend's TLS certificate")
+	shutdownTimeoutPtr := fs.Duration("shutdown-timeout", shutdownTimeoutDefault, "time to wait for in-flight transfers to finish on SIGTERM/SIGINT")
+	cacheDirPtr := fs.String("cache-dir", "", "directory to cache backend responses in (disabled if empty)")
+	cacheMaxSizePtr := fs.Int64("cache-max-size", 0, "maximum total size in bytes of the on-disk cache, 0 for unbounded")
+	cacheTTLPtr := fs.Duration("cache-ttl", 0, "how long a cached response is served before being revalidated against the backend, 0 to never revalidate")
+	enableWritePtr := fs.Bool("enable-write", false, "accept TFTP WRQ uploads and forward them to the HTTP backend")
+	writeMethodPtr := fs.String("write-method", writeMethodDefault, "HTTP method used to forward TFTP uploads (PUT or POST)")
+	metricsAddrPtr := fs.String("metrics-addr", metricsAddrDefault, "address to serve /metrics, /healthz and /readyz on")
+	rulesFilePtr := fs.String("rules-file", "", "YAML/JSON file of per-client-subnet/per-filename routing rules (overrides --http-base-url when set)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("unable to parse flags: %v", err)
+	}
+
+	baseUrl, err := normalizeBaseURL(*httpBaseUrlPtr, *appendPathPtr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --http-base-url: %v", err)
+	}
+
+	tlsConfig, err := buildTLSConfig(*httpTLSCa, *httpTLSClientCert, *httpTLSClientKey, *httpTLSInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	ac := &appliedConfig{
+		httpBaseUrl: baseUrl,
+		httpClient: &http.Client{
+			Transport: transport,
+		},
+		appendPath:   *appendPathPtr,
+		authUsername: *authUsername,
+		authPassword: *authPassword,
+		cacheDir:     *cacheDirPtr,
+		cacheMaxSize: *cacheMaxSizePtr,
+		cacheTTL:     *cacheTTLPtr,
+		enableWrite:  *enableWritePtr,
+		writeMethod:  *writeMethodPtr,
+		rulesFile:    *rulesFilePtr,
+		cfg: config{
+			bindAddr:        *bindAddrPtr,
+			tftpTimeout:     *tftpTimeoutPtr,
+			shutdownTimeout: *shutdownTimeoutPtr,
+			metricsAddr:     *metricsAddrPtr,
+		},
+	}
+
+	if *rulesFilePtr != "" {
+		if *rulesFilePtr == globalState.rulesFile && globalState.rules != nil {
+			ac.rules = globalState.rules
+		} else {
+			engine, err := rules.Load(*rulesFilePtr)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load rules file: %v", err)
+			}
+			ac.rules = engine
+		}
+	}
+
+	if *cacheDirPtr != "" {
+		if *cacheDirPtr == globalState.cacheDir && *cacheMaxSizePtr == globalState.cacheMaxSize &&
+			*cacheTTLPtr == globalState.cacheTTL && globalState.cache != nil {
+			ac.cache = globalState.cache
 		} else {
-			log.Printf("DEBUG: Systemd notifications are not supported.\n")
+			c, err := cache.New(*cacheDirPtr, *cacheMaxSizePtr, *cacheTTLPtr)
+			if err != nil {
+				return nil, fmt.Errorf("unable to set up cache: %v", err)
+			}
+			ac.cache = c
 		}
-	})
+	}
+
+	return ac, nil
+}
+
+// apply commits ac onto globalState.
+func (ac *appliedConfig) apply() {
+	globalState.httpBaseUrl = ac.httpBaseUrl
+	globalState.httpClient = ac.httpClient
+	globalState.appendPath = ac.appendPath
+	globalState.authUsername = ac.authUsername
+	globalState.authPassword = ac.authPassword
+	globalState.cacheDir = ac.cacheDir
+	globalState.cacheMaxSize = ac.cacheMaxSize
+	globalState.cacheTTL = ac.cacheTTL
+	globalState.cache = ac.cache
+	globalState.enableWrite = ac.enableWrite
+	globalState.writeMethod = ac.writeMethod
+	globalState.rulesFile = ac.rulesFile
+	globalState.rules = ac.rules
+}
+
+// parseFlags parses and applies args at startup. A bad flag or config file
+// here is a configuration mistake that should stop the process before it
+// ever binds a socket, so it panics instead of returning an error.
+func parseFlags(args []string) config {
+	ac, err := parseFlagsArgs(args)
+	if err != nil {
+		log.Panicf("FATAL: %v\n", err)
+	}
+	ac.apply()
+	return ac.cfg
+}
+
+// reloadFlags re-parses args for a SIGHUP reload. Unlike parseFlags, a bad
+// flag or config file is logged and the previous configuration is kept
+// instead of crashing the process: a reload races in-flight transfers, and
+// failing to pick up new configuration is far less harmful than taking the
+// whole daemon down over it. It reports whether the reload was applied.
+func reloadFlags(args []string) bool {
+	ac, err := parseFlagsArgs(args)
 	if err != nil {
-		log.Panicf("FATAL: tftp server: %v\n", err)
+		log.Printf("ERR: SIGHUP reload failed, keeping previous configuration: %v\n", err)
+		return false
 	}
+	ac.apply()
+	return true
+}
+
+// cacheHitRatioUpdater periodically refreshes the cache hit-ratio gauge
+// from the cache's hit/miss counters, when caching is enabled.
+func cacheHitRatioUpdater() {
+	for range time.Tick(10 * time.Second) {
+		if globalState.cache == nil {
+			continue
+		}
+		hits, misses := globalState.cache.Stats()
+		if total := hits + misses; total > 0 {
+			metrics.CacheHitRatio.Set(float64(hits) / float64(total))
+		}
+	}
+}
+
+// waitForDrain blocks until every in-flight transfer tracked by
+// transfersWg has finished or timeout elapses, whichever comes first. It is
+// shared by the SIGTERM/SIGINT shutdown path and the SIGUSR2 handoff path,
+// since both need the process to stop serving new requests without cutting
+// off transfers already in progress.
+func waitForDrain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		transfersWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Printf("INFO: All in-flight transfers finished\n")
+	case <-time.After(timeout):
+		log.Printf("WARN: Shutdown timeout reached with transfers still in flight\n")
+	}
+}
+
+// handleSignals traps SIGTERM/SIGINT (graceful shutdown), SIGHUP (config
+// reload) and SIGUSR2 (inherited-socket re-exec) for as long as the process
+// runs. It returns once a shutdown signal has been fully handled, at which
+// point main() should exit. main() must wait for handleSignals to return
+// before the process exits, or the in-flight-transfer drain and the
+// systemd STOPPING=1 notification race the process teardown.
+func handleSignals(s *tftp.Server, conn *net.UDPConn, cfg config) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGTERM, syscall.SIGINT:
+			log.Printf("INFO: Received %s, shutting down gracefully (timeout %s)\n", sig, cfg.shutdownTimeout)
+			s.Shutdown()
+			waitForDrain(cfg.shutdownTimeout)
+
+			if _, err := systemd.SdNotify(false, "STOPPING=1\n"); err != nil {
+				log.Printf("WARN: Unable to send systemd stopping notification: %v\n", err)
+			}
+			return
+
+		case syscall.SIGHUP:
+			log.Printf("INFO: Received SIGHUP, reloading configuration\n")
+			if _, err := systemd.SdNotify(false, "RELOADING=1\n"); err != nil {
+				log.Printf("WARN: Unable to send systemd reloading notification: %v\n", err)
+			}
+			if reloadFlags(os.Args[1:]) {
+				log.Printf("INFO: Configuration reloaded\n")
+			}
+			if _, err := systemd.SdNotify(false, "READY=1\n"); err != nil {
+				log.Printf("WARN: Unable to send systemd ready notification: %v\n", err)
+			}
+
+		case syscall.SIGUSR2:
+			log.Printf("INFO: Received SIGUSR2, re-executing with inherited TFTP socket\n")
+			if err := reExecWithInheritedSocket(conn); err != nil {
+				log.Printf("ERR: Re-exec failed, continuing to serve: %v\n", err)
+				continue
+			}
+
+			// The child now holds its own fd for the same underlying
+			// socket, so the parent must stop accepting new top-level
+			// requests itself: otherwise both processes race to read
+			// fresh RRQ/WRQ packets off the shared socket. Shutdown
+			// only stops the accept loop; it does not touch transfers
+			// already in flight, which is why we still drain them below
+			// before the parent is allowed to exit.
+			log.Printf("INFO: Draining in-flight transfers before exiting; new requests are now served by the child\n")
+			s.Shutdown()
+			waitForDrain(cfg.shutdownTimeout)
+			return
+		}
+	}
+}
+
+// reExecWithInheritedSocket forks a copy of the running binary, passing the
+// already-bound UDP socket as fd 3, so the child can start serving new TFTP
+// requests while the parent keeps draining the transfers it already has in
+// flight.
+func reExecWithInheritedSocket(conn *net.UDPConn) error {
+	connFile, err := conn.File()
+	if err != nil {
+		return fmt.Errorf("unable to obtain socket file: %v", err)
+	}
+	defer connFile.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{connFile}
+	cmd.Env = append(os.Environ(), inheritFdEnv+"=1")
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start child process: %v", err)
+	}
+	log.Printf("INFO: Spawned child process (pid %d) to take over new requests\n", cmd.Process.Pid)
+	return nil
+}
+
+// bindTFTPSocket binds the TFTP UDP socket, adopting the one inherited from
+// a SIGUSR2 parent (fd 3) when present instead of binding a fresh one.
+func bindTFTPSocket(bindAddr string) (*net.UDPConn, error) {
+	if os.Getenv(inheritFdEnv) == "1" {
+		inheritedFile := os.NewFile(3, "tftp-socket")
+		conn, err := net.FilePacketConn(inheritedFile)
+		inheritedFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to adopt inherited socket: %v", err)
+		}
+		log.Printf("INFO: Adopted inherited TFTP socket\n")
+		return conn.(*net.UDPConn), nil
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve bind address: %v", err)
+	}
+	return net.ListenUDP("udp", udpAddr)
+}
+
+func main() {
+	cfg := parseFlags(os.Args[1:])
+
+	conn, err := bindTFTPSocket(cfg.bindAddr)
+	if err != nil {
+		log.Panicf("FATAL: unable to bind TFTP socket: %v\n", err)
+	}
+
+	var writeHandler func(filename string, wt io.WriterTo) error
+	if globalState.enableWrite {
+		writeHandler = tftpWriteHandler
+	}
+	s := tftp.NewServer(tftpReadHandler, writeHandler)
+	s.SetTimeout(cfg.tftpTimeout)
+
+	signalsDone := make(chan struct{})
+	go func() {
+		handleSignals(s, conn, cfg)
+		close(signalsDone)
+	}()
+	go cacheHitRatioUpdater()
+	go func() {
+		readyCheck := metrics.BackendHeadCheck(func() (*http.Client, string) {
+			return globalState.httpClient, globalState.httpBaseUrl
+		}, cfg.tftpTimeout)
+		if err := metrics.Serve(cfg.metricsAddr, readyCheck); err != nil {
+			log.Printf("ERR: metrics server stopped: %v\n", err)
+		}
+	}()
+
+	log.Printf("INFO: Listening TFTP requests on: %s", cfg.bindAddr)
+	sent, err := systemd.SdNotify(true, "READY=1\n")
+	if err != nil {
+		log.Printf("WARN: Unable to send systemd daemon successful start message: %v\n", err)
+	} else if sent {
+		log.Printf("DEBUG: Systemd was notified.\n")
+	} else {
+		log.Printf("DEBUG: Systemd notifications are not supported.\n")
+	}
+
+	// Serve has no return value; it blocks until Shutdown() is called
+	// (from the signal handler) and then returns.
+	s.Serve(conn)
+
+	// Serve returns as soon as s.Shutdown() is called, but the transfer
+	// drain and systemd notification handleSignals does afterwards still
+	// need to finish before the process exits.
+	<-signalsDone
 }
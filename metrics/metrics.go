@@ -0,0 +1,112 @@
+// Package metrics declares the Prometheus instruments exported by
+// tftp-http-proxy and the embedded HTTP server that serves them alongside
+// the /healthz and /readyz endpoints.
+package metrics
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// RequestsTotal counts TFTP read requests by outcome ("ok", "not_found", "error").
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tftp_http_proxy_requests_total",
+		Help: "Total TFTP read requests, by status.",
+	}, []string{"status"})
+
+	// BytesServed is the cumulative number of body bytes served to TFTP clients.
+	BytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tftp_http_proxy_bytes_served_total",
+		Help: "Total bytes served to TFTP clients.",
+	})
+
+	// BackendLatency tracks how long fetching a file takes: the HTTP request
+	// to the backend or, when caching is enabled, the whole cache lookup, so
+	// cache hits served from disk are observed too.
+	BackendLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tftp_http_proxy_backend_request_duration_seconds",
+		Help:    "Latency of fetching a file from the backend, or from the cache when caching is enabled.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// TransferDuration tracks the wall-clock duration of whole TFTP transfers.
+	TransferDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tftp_http_proxy_transfer_duration_seconds",
+		Help:    "Duration of TFTP transfers, start to finish.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// InFlightTransfers is the number of TFTP transfers currently in progress.
+	InFlightTransfers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tftp_http_proxy_in_flight_transfers",
+		Help: "Number of TFTP transfers currently in progress.",
+	})
+
+	// CacheHitRatio is the fraction of cache lookups served without hitting the backend.
+	CacheHitRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tftp_http_proxy_cache_hit_ratio",
+		Help: "Ratio of cache hits to total cache lookups, when caching is enabled.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(RequestsTotal, BytesServed, BackendLatency, TransferDuration, InFlightTransfers, CacheHitRatio)
+}
+
+// Serve starts the embedded metrics/health HTTP server on addr and blocks
+// until it stops. readyCheck is called for each /readyz request and should
+// verify the HTTP backend is reachable.
+func Serve(addr string, readyCheck func() error) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := readyCheck(); err != nil {
+			log.Printf("WARN: readyz check failed: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	log.Printf("INFO: Listening metrics/health requests on: %s", addr)
+	return srv.ListenAndServe()
+}
+
+// BackendHeadCheck returns a readyCheck func that issues a HEAD request
+// against the HTTP backend, failing if it does not respond within timeout.
+// target is called on every check rather than once up front, so a config
+// reload that swaps in a new client/base URL (e.g. over SIGHUP) is picked
+// up by the next /readyz probe instead of the check running forever
+// against whatever was current at startup.
+func BackendHeadCheck(target func() (client *http.Client, baseURL string), timeout time.Duration) func() error {
+	return func() error {
+		client, baseURL := target()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, "HEAD", baseURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+}
@@ -0,0 +1,149 @@
+// Package rules implements the per-client-subnet / per-filename routing
+// engine loaded from --rules-file. It replaces the single global backend
+// base URL with an ordered list of rules matched on client IP CIDR and/or
+// filename regex, each producing its own target base URL, optional
+// filename rewrite, auth and deny action.
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Rule is a single routing rule as read from the rules file.
+type Rule struct {
+	Name          string `yaml:"name" json:"name"`
+	CIDR          string `yaml:"cidr,omitempty" json:"cidr,omitempty"`
+	FilenameRegex string `yaml:"filename_regex,omitempty" json:"filename_regex,omitempty"`
+	BaseURL       string `yaml:"base_url,omitempty" json:"base_url,omitempty"`
+	Rewrite       string `yaml:"rewrite,omitempty" json:"rewrite,omitempty"`
+	AuthUsername  string `yaml:"auth_user,omitempty" json:"auth_user,omitempty"`
+	AuthPassword  string `yaml:"auth_pass,omitempty" json:"auth_pass,omitempty"`
+	Deny          bool   `yaml:"deny,omitempty" json:"deny,omitempty"`
+
+	cidr       *net.IPNet
+	filenameRe *regexp.Regexp
+}
+
+// Engine evaluates an ordered list of rules against a client IP and
+// filename to find where a TFTP request should be routed.
+type Engine struct {
+	rules []*Rule
+}
+
+// Match is the outcome of resolving a request against the rules engine.
+type Match struct {
+	BaseURL      string
+	Filename     string
+	AuthUsername string
+	AuthPassword string
+	Deny         bool
+}
+
+// validateBaseURL checks that raw has both a scheme and a host, the same
+// shape main.normalizeBaseURL requires of --http-base-url. Rejecting
+// malformed base URLs here, at load time, keeps a typo'd rule from
+// surfacing as an error on the first TFTP request that matches it instead
+// of at startup.
+func validateBaseURL(raw string) error {
+	u, err := url.ParseRequestURI(raw)
+	if err != nil {
+		return fmt.Errorf("invalid base_url %q: %v", raw, err)
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("invalid base_url %q: no scheme found", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid base_url %q: no host found", raw)
+	}
+	return nil
+}
+
+// Load reads and compiles the rules file at path. YAML is used unless the
+// extension is .json.
+func Load(path string) (*Engine, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rules file: %v", err)
+	}
+
+	var ruleSet struct {
+		Rules []*Rule `yaml:"rules" json:"rules"`
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(raw, &ruleSet); err != nil {
+			return nil, fmt.Errorf("unable to parse rules file as JSON: %v", err)
+		}
+	} else {
+		if err := yaml.Unmarshal(raw, &ruleSet); err != nil {
+			return nil, fmt.Errorf("unable to parse rules file as YAML: %v", err)
+		}
+	}
+
+	for i, rule := range ruleSet.Rules {
+		if rule.CIDR != "" {
+			_, cidr, err := net.ParseCIDR(rule.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d (%s): invalid cidr %q: %v", i, rule.Name, rule.CIDR, err)
+			}
+			rule.cidr = cidr
+		}
+		if rule.FilenameRegex != "" {
+			re, err := regexp.Compile(rule.FilenameRegex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d (%s): invalid filename_regex %q: %v", i, rule.Name, rule.FilenameRegex, err)
+			}
+			rule.filenameRe = re
+		}
+		if !rule.Deny && rule.BaseURL == "" {
+			return nil, fmt.Errorf("rule %d (%s): must set base_url unless deny is true", i, rule.Name)
+		}
+		if rule.BaseURL != "" {
+			if err := validateBaseURL(rule.BaseURL); err != nil {
+				return nil, fmt.Errorf("rule %d (%s): %v", i, rule.Name, err)
+			}
+		}
+	}
+
+	return &Engine{rules: ruleSet.Rules}, nil
+}
+
+// Resolve walks the rules in order and returns the Match produced by the
+// first one whose CIDR and filename_regex (whichever are set) both match.
+func (e *Engine) Resolve(ip net.IP, filename string) (*Match, error) {
+	for _, rule := range e.rules {
+		if rule.cidr != nil && !rule.cidr.Contains(ip) {
+			continue
+		}
+		if rule.filenameRe != nil && !rule.filenameRe.MatchString(filename) {
+			continue
+		}
+
+		if rule.Deny {
+			return &Match{Deny: true}, nil
+		}
+
+		resolvedFilename := filename
+		if rule.filenameRe != nil && rule.Rewrite != "" {
+			resolvedFilename = rule.filenameRe.ReplaceAllString(filename, rule.Rewrite)
+		}
+
+		return &Match{
+			BaseURL:      rule.BaseURL,
+			Filename:     resolvedFilename,
+			AuthUsername: rule.AuthUsername,
+			AuthPassword: rule.AuthPassword,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no rule matched client %s requesting %q", ip, filename)
+}
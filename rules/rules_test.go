@@ -0,0 +1,144 @@
+package rules
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestEngineResolve(t *testing.T) {
+	officeCIDR := "10.0.0.0/24"
+	_, officeNet, err := net.ParseCIDR(officeCIDR)
+	if err != nil {
+		t.Fatalf("invalid test CIDR: %v", err)
+	}
+
+	e := &Engine{rules: []*Rule{
+		{
+			Name:       "deny-secret",
+			Deny:       true,
+			filenameRe: regexp.MustCompile(`^secret/`),
+		},
+		{
+			Name:         "office",
+			CIDR:         officeCIDR,
+			cidr:         officeNet,
+			BaseURL:      "http://office-backend/",
+			AuthUsername: "office",
+		},
+		{
+			Name:          "rewrite-firmware",
+			FilenameRegex: `^fw-(.+)\.bin$`,
+			filenameRe:    regexp.MustCompile(`^fw-(.+)\.bin$`),
+			BaseURL:       "http://firmware-backend/",
+			Rewrite:       "images/$1.bin",
+		},
+		{
+			Name:    "fallback",
+			BaseURL: "http://default-backend/",
+		},
+	}}
+
+	tests := []struct {
+		name         string
+		ip           string
+		filename     string
+		wantDeny     bool
+		wantBaseURL  string
+		wantFilename string
+	}{
+		{
+			name:     "deny rule matches regardless of client ip",
+			ip:       "10.0.0.5",
+			filename: "secret/firmware.bin",
+			wantDeny: true,
+		},
+		{
+			name:         "cidr match routes to office backend",
+			ip:           "10.0.0.5",
+			filename:     "boot.img",
+			wantBaseURL:  "http://office-backend/",
+			wantFilename: "boot.img",
+		},
+		{
+			name:         "filename regex match rewrites the path",
+			ip:           "203.0.113.1",
+			filename:     "fw-router1.bin",
+			wantBaseURL:  "http://firmware-backend/",
+			wantFilename: "images/router1.bin",
+		},
+		{
+			name:         "no more specific rule matches falls through to fallback",
+			ip:           "203.0.113.1",
+			filename:     "boot.img",
+			wantBaseURL:  "http://default-backend/",
+			wantFilename: "boot.img",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := e.Resolve(net.ParseIP(tt.ip), tt.filename)
+			if err != nil {
+				t.Fatalf("Resolve() unexpected error: %v", err)
+			}
+			if match.Deny != tt.wantDeny {
+				t.Errorf("Deny = %v, want %v", match.Deny, tt.wantDeny)
+			}
+			if tt.wantDeny {
+				return
+			}
+			if match.BaseURL != tt.wantBaseURL {
+				t.Errorf("BaseURL = %q, want %q", match.BaseURL, tt.wantBaseURL)
+			}
+			if match.Filename != tt.wantFilename {
+				t.Errorf("Filename = %q, want %q", match.Filename, tt.wantFilename)
+			}
+		})
+	}
+}
+
+func TestEngineResolveNoMatch(t *testing.T) {
+	_, officeNet, _ := net.ParseCIDR("10.0.0.0/24")
+	e := &Engine{rules: []*Rule{
+		{Name: "office", CIDR: "10.0.0.0/24", cidr: officeNet, BaseURL: "http://office-backend/"},
+	}}
+
+	if _, err := e.Resolve(net.ParseIP("203.0.113.1"), "boot.img"); err == nil {
+		t.Fatal("Resolve() expected an error when no rule matches, got none")
+	}
+}
+
+func TestLoadRejectsMalformedBaseURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	contents := "rules:\n  - name: typo\n    base_url: \"office-backend\"\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("unable to write test rules file: %v", err)
+	}
+
+	if _, err := Load(path); err == nil {
+		t.Fatal("Load() expected an error for a base_url without a scheme, got none")
+	}
+}
+
+func TestLoadAcceptsDenyRuleWithoutBaseURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	contents := "rules:\n  - name: block-all\n    deny: true\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("unable to write test rules file: %v", err)
+	}
+
+	e, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() unexpected error: %v", err)
+	}
+	match, err := e.Resolve(net.ParseIP("203.0.113.1"), "anything")
+	if err != nil {
+		t.Fatalf("Resolve() unexpected error: %v", err)
+	}
+	if !match.Deny {
+		t.Fatal("expected the deny-all rule to match")
+	}
+}